@@ -6,7 +6,11 @@ package supervisor
 
 import (
 	"context"
+	"fmt"
+	"io"
+	"path"
 	"sync"
+	"time"
 
 	"github.com/grpc-ecosystem/grpc-gateway/v2/runtime"
 	"google.golang.org/grpc"
@@ -21,14 +25,86 @@ import (
 const (
 	NotifierMaxPendingNotifications   = 120
 	SubscriberMaxPendingNotifications = 100
+
+	// subscriberBackpressureTimeout is how long notifySubscribers blocks on a
+	// full subscriber channel before giving up and cancelling the subscriber.
+	// This absorbs momentary slow consumers (e.g. a GC pause in the IDE
+	// front-end) instead of evicting them outright.
+	subscriberBackpressureTimeout = 5 * time.Second
+
+	// systemTopic carries synthetic notifications about the notification bus
+	// itself (subscribe/unsubscribe lifecycle events), so tooling can observe
+	// it the same way it observes any other topic.
+	systemTopic = "system"
+
+	// defaultProgressLeaseSeconds is how long a progress notification may go
+	// without a ReportProgress renewal before it is treated as abandoned.
+	// Overridable per-notification via NotifyRequest.LeaseSeconds.
+	defaultProgressLeaseSeconds = 30
+
+	// leaseSweepInterval is how often expireLeases scans for progress
+	// notifications whose lease has lapsed without a renewal.
+	leaseSweepInterval = 5 * time.Second
+
+	// claimResponseFallbackTimeout bounds how long a claim may go unanswered
+	// before it's treated as abandoned, for the case where the claimer's
+	// ClaimResponseRequest didn't identify its own SubscriberId. A claim that
+	// does identify its subscriber is instead expired as soon as that
+	// subscriber's Subscribe stream disconnects (see unsubscribeLocked),
+	// which doesn't force a deadline onto the user actually deciding.
+	claimResponseFallbackTimeout = 1 * time.Hour
 )
 
-// NewNotificationService creates a new notification service.
+// notificationLevelRank orders api.NotifyRequest levels so a subscription
+// filter's MinLevel can be compared against an incoming notification's Level.
+// Unknown levels rank the same as INFO, the most permissive level.
+var notificationLevelRank = map[string]int{
+	"INFO":  0,
+	"WARN":  1,
+	"ERROR": 2,
+}
+
+// NewNotificationService creates a new notification service backed by the
+// durable BoltDB-backed NotificationStore, so a supervisor restart doesn't
+// drop a blocking prompt or force a reconnecting IDE to replay from an empty
+// backlog. Falls back to an in-memory store if the durable store can't be
+// opened, e.g. because /workspace isn't writable in this environment.
 func NewNotificationService() *NotificationService {
-	return &NotificationService{
-		subscriptions:        make(map[uint64]*subscription),
+	store, err := NewBoltNotificationStore()
+	if err != nil {
+		log.WithError(err).Error("failed to open persistent notification store; falling back to an in-memory one, so notifications will not survive a supervisor restart")
+		store = NewMemoryNotificationStore()
+	}
+	return NewNotificationServiceWithStore(store)
+}
+
+// NewNotificationServiceWithStore creates a new notification service whose
+// replay backlog is persisted to store, e.g. a boltNotificationStore so it
+// survives a supervisor restart.
+func NewNotificationServiceWithStore(store NotificationStore) *NotificationService {
+	srv := &NotificationService{
+		subscriptions: make(map[uint64]*subscription),
+		// starts at 1, not the zero value, so 0 can serve as the "no
+		// subscriber" sentinel in ClaimResponseRequest.SubscriberId.
+		nextSubscriptionID:   1,
 		pendingNotifications: make(map[uint64]*pendingNotification),
+		// starts at 1 too, so SinceSequence 0 means "seen nothing" and
+		// Since(0) replays every record.
+		nextSequence:        1,
+		backpressureTimeout: subscriberBackpressureTimeout,
+		store:               store,
+	}
+	// Resume numbering where a prior process left off: starting back at 1
+	// would silently overwrite store's existing records at the same Bolt
+	// keys, and would leave every already-issued SinceSequence checkpoint
+	// permanently ahead of anything this process ever hands out.
+	if next, err := store.NextSequence(); err != nil {
+		log.WithError(err).Error("failed to read next notification sequence from the store; resuming from 1, which may collide with previously persisted records")
+	} else if next > srv.nextSequence {
+		srv.nextSequence = next
 	}
+	go srv.expireLeasesLoop()
+	return srv
 }
 
 // NotificationService implements the notification service API.
@@ -38,8 +114,20 @@ type NotificationService struct {
 	nextSubscriptionID uint64
 	subscriptions      map[uint64]*subscription
 
-	nextNotificationID   uint64
-	pendingNotifications map[uint64]*pendingNotification
+	nextSequence         uint64
+	pendingNotifications map[uint64]*pendingNotification // keyed by Sequence
+
+	// nextResponderToken hands out the token a Notify's SubscribeResponse is
+	// tagged with, so ClaimResponse can tell a fresh claim from a stale one.
+	nextResponderToken uint64
+
+	// backpressureTimeout is the configurable deadline notifySubscribers
+	// waits on a full subscriber channel before cancelling the subscriber.
+	backpressureTimeout time.Duration
+
+	// store persists notifications so a subscriber can replay the backlog
+	// across a supervisor restart via SubscribeRequest.SinceSequence.
+	store NotificationStore
 
 	api.UnimplementedNotificationServiceServer
 }
@@ -49,6 +137,30 @@ type pendingNotification struct {
 	responseChannel chan *api.NotifyResponse
 	once            sync.Once
 	closed          bool
+
+	// leaseDeadline is when this notification is considered abandoned absent
+	// further activity: a ReportProgress renewal for a progress notification,
+	// or (only when claimedBySubscriberID is unknown) a Respond for one a
+	// ClaimResponse winner has claimed. Zero otherwise, meaning it waits for a
+	// response indefinitely as before.
+	leaseDeadline time.Time
+	// expired marks that close() was triggered by a lapsed lease rather than
+	// a response or a cancelled Notify, so Notify can report the right code.
+	expired bool
+
+	// responderToken matches message.ResponderToken; ClaimResponse checks a
+	// caller's token against it to reject a claim racing a withdrawn/expired
+	// notification.
+	responderToken uint64
+	// claimed is set by the first successful ClaimResponse call. Respond
+	// requires it, so two subscribers racing to answer the same prompt can't
+	// both believe they won.
+	claimed bool
+	// claimedBySubscriberID is the subscription that won the claim, when its
+	// ClaimResponseRequest.SubscriberId identified it. unsubscribeLocked
+	// expires the claim as soon as that subscription disconnects, instead of
+	// forcing a fixed response deadline onto the user who's still deciding.
+	claimedBySubscriberID uint64
 }
 
 func (pending *pendingNotification) close() {
@@ -58,13 +170,79 @@ func (pending *pendingNotification) close() {
 	})
 }
 
+// expire closes the pending notification because it was abandoned, either
+// because its leaseDeadline lapsed or because the subscriber that claimed it
+// disconnected, unblocking Notify with codes.DeadlineExceeded.
+func (pending *pendingNotification) expire() {
+	pending.once.Do(func() {
+		pending.expired = true
+		close(pending.responseChannel)
+		pending.closed = true
+	})
+}
+
 type subscription struct {
+	// id is 1-based; 0 is reserved as the "no subscriber" sentinel in
+	// ClaimResponseRequest.SubscriberId.
 	id      uint64
 	active  bool
+	filter  subscriptionFilter
 	channel chan *api.SubscribeResponse
 	once    sync.Once
 	closed  bool
 	cancel  context.CancelFunc
+
+	// ready becomes true once subscribeLocked has flushed the initial
+	// pendingNotifications backlog and sent the activation ack. Until then,
+	// notifySubscribers buffers into queue instead of writing to channel, so
+	// a fast Notify racing this Subscribe call can never be silently
+	// dropped. Guarded by NotificationService.mutex.
+	ready bool
+	queue []*api.SubscribeResponse
+}
+
+// subscriptionFilter is the compiled form of api.Filter, evaluated by
+// supports for every Notify. The zero value (or a nil api.Filter on the
+// SubscribeRequest) matches everything, preserving the behaviour of seeing
+// every notification that predates per-subscription filtering.
+type subscriptionFilter struct {
+	topics   map[string]struct{}
+	minLevel int
+	pattern  string
+}
+
+func newSubscriptionFilter(f *api.Filter) subscriptionFilter {
+	if f == nil {
+		return subscriptionFilter{}
+	}
+	topics := make(map[string]struct{}, len(f.Topics))
+	for _, topic := range f.Topics {
+		topics[topic] = struct{}{}
+	}
+	return subscriptionFilter{
+		topics:   topics,
+		minLevel: notificationLevelRank[f.Level.String()],
+		pattern:  f.Message,
+	}
+}
+
+// matches reports whether req passes the filter's topic, level and message
+// glob criteria. An empty topic set or pattern is treated as "any".
+func (f subscriptionFilter) matches(req *api.NotifyRequest) bool {
+	if len(f.topics) > 0 {
+		if _, ok := f.topics[req.Topic]; !ok {
+			return false
+		}
+	}
+	if notificationLevelRank[req.Level.String()] < f.minLevel {
+		return false
+	}
+	if f.pattern != "" {
+		if ok, err := path.Match(f.pattern, req.Message); err != nil || !ok {
+			return false
+		}
+	}
+	return true
 }
 
 func (subscription *subscription) close() {
@@ -95,6 +273,10 @@ func (srv *NotificationService) Notify(ctx context.Context, req *api.NotifyReque
 	select {
 	case resp, ok := <-pending.responseChannel:
 		if !ok {
+			if pending.expired {
+				log.WithField("requestId", pending.message.RequestId).Info("notification lease expired without a progress update")
+				return nil, status.Error(codes.DeadlineExceeded, "notification lease expired without a progress update")
+			}
 			log.Error("notify response channel has been closed")
 			return nil, status.Error(codes.Aborted, "response channel closed")
 		}
@@ -103,62 +285,303 @@ func (srv *NotificationService) Notify(ctx context.Context, req *api.NotifyReque
 	case <-ctx.Done():
 		log.Info("notify cancelled")
 		srv.mutex.Lock()
-		defer srv.mutex.Unlock()
 		// make sure the notification has not been responded in between these selectors
 		_, ok := srv.pendingNotifications[pending.message.RequestId]
 		if ok {
 			delete(srv.pendingNotifications, pending.message.RequestId)
 			pending.close()
 		}
+		srv.mutex.Unlock()
+		if ok {
+			// Nothing else tells subscribers that this notification is gone;
+			// tell them explicitly so a stale prompt doesn't linger in their
+			// UI.
+			srv.publishWithdrawn(pending.message.RequestId, pending.message.Request, 0)
+		}
 		return nil, ctx.Err()
 	}
 }
 
 func (srv *NotificationService) notifySubscribers(req *api.NotifyRequest) *pendingNotification {
 	srv.mutex.Lock()
-	defer srv.mutex.Unlock()
+	srv.nextResponderToken++
 	var (
-		requestID = srv.nextNotificationID
+		requestID = srv.nextSequence
 		message   = &api.SubscribeResponse{
-			RequestId: requestID,
-			Request:   req,
+			RequestId:      requestID,
+			Sequence:       requestID,
+			Request:        req,
+			ResponderToken: srv.nextResponderToken,
 		}
 	)
-	srv.nextNotificationID++
-	for _, subscription := range srv.subscriptions {
-		if !subscription.supports(req) {
-			continue
-		}
-		select {
-		case subscription.channel <- message:
-			// all good
-		default:
-			// subscriber doesn't consume messages fast enough
-			log.WithField("subscription", req).Info("Cancelling unresponsive subscriber")
-			delete(srv.subscriptions, subscription.id)
-			subscription.close()
-		}
-	}
+	srv.nextSequence++
+	targets := srv.broadcastLocked(req, message, 0)
+
 	channel := make(chan *api.NotifyResponse, 1)
 	pending := &pendingNotification{
 		message:         message,
 		responseChannel: channel,
+		responderToken:  message.ResponderToken,
+	}
+	if req.Progress != nil {
+		pending.leaseDeadline = time.Now().Add(progressLeaseDuration(req))
 	}
-	srv.pendingNotifications[requestID] = pending
-	if !isBlocking(req) {
-		// produce an immediate response
+	blocking := isBlocking(req)
+	if !blocking {
+		// produce an immediate response. Nothing will ever call Respond for
+		// this one, so unlike a blocking notification it's never added to
+		// pendingNotifications in the first place: there would be no
+		// ctx.Done(), lease expiry, claim or Respond call left to ever
+		// remove it, and it would linger in the map for the life of the
+		// process.
 		channel <- &api.NotifyResponse{}
 		pending.close()
+	} else {
+		srv.pendingNotifications[requestID] = pending
+	}
+	// Persisting while still holding srv.mutex keeps sequence assignment,
+	// the store write, and subscribeLocked's backlog/checkpoint read atomic
+	// with each other. Splitting them let a Subscribe race a Notify: it
+	// could read store.Since before this record was appended yet still
+	// capture a checkpoint already past its sequence, silently losing the
+	// notification from both the initial backlog and any future replay.
+	if err := srv.store.Append(&NotificationRecord{Sequence: requestID, Message: message}); err != nil {
+		log.WithError(err).Error("failed to persist notification")
+	}
+	if !blocking {
+		// Nothing will ever call Respond for this one, so it would otherwise
+		// linger in the store forever and get replayed to every reconnect.
+		if err := srv.store.MarkAnswered(requestID, &api.NotifyResponse{}); err != nil {
+			log.WithError(err).Error("failed to mark notification answered in store")
+		}
+	}
+	srv.mutex.Unlock()
+
+	for _, subscription := range targets {
+		srv.deliver(subscription, message)
 	}
+
 	return pending
 }
 
+// ReportProgress streams lease-renewing progress updates for an in-flight
+// progress notification. Each ProgressUpdate both renews the corresponding
+// pendingNotification's lease and is broadcast to matching subscribers as a
+// SubscribeResponse.ProgressUpdate, so the IDE UI can move the bar without
+// the responder having to call Respond first.
+func (srv *NotificationService) ReportProgress(stream api.NotificationService_ReportProgressServer) error {
+	for {
+		update, err := stream.Recv()
+		if err == io.EOF {
+			return stream.SendAndClose(&api.ProgressAck{})
+		}
+		if err != nil {
+			return status.Errorf(codes.Internal, "receiving progress update failed. %s", err)
+		}
+		if err := srv.renewLease(update); err != nil {
+			return err
+		}
+	}
+}
+
+// renewLease pushes update's percent/message to matching subscribers and
+// extends the lease of the pending notification it belongs to.
+func (srv *NotificationService) renewLease(update *api.ProgressUpdate) error {
+	srv.mutex.Lock()
+	pending, ok := srv.pendingNotifications[update.RequestId]
+	if !ok {
+		srv.mutex.Unlock()
+		return status.Errorf(codes.NotFound, "no pending notification with id %d", update.RequestId)
+	}
+	pending.leaseDeadline = time.Now().Add(progressLeaseDuration(pending.message.Request))
+	resp := &api.SubscribeResponse{RequestId: update.RequestId, ProgressUpdate: update}
+	targets := srv.broadcastLocked(pending.message.Request, resp, 0)
+	srv.mutex.Unlock()
+
+	for _, subscription := range targets {
+		srv.deliver(subscription, resp)
+	}
+	return nil
+}
+
+// expireLeasesLoop periodically sweeps pendingNotifications for progress
+// notifications whose lease lapsed without a ReportProgress renewal.
+func (srv *NotificationService) expireLeasesLoop() {
+	ticker := time.NewTicker(leaseSweepInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		srv.expireLeases()
+	}
+}
+
+func (srv *NotificationService) expireLeases() {
+	now := time.Now()
+
+	srv.mutex.Lock()
+	var expired []*pendingNotification
+	for id, pending := range srv.pendingNotifications {
+		if pending.leaseDeadline.IsZero() || pending.leaseDeadline.After(now) {
+			continue
+		}
+		delete(srv.pendingNotifications, id)
+		expired = append(expired, pending)
+	}
+	srv.mutex.Unlock()
+
+	for _, pending := range expired {
+		log.WithField("requestId", pending.message.RequestId).Info("notification lease expired")
+		pending.expire()
+		// Otherwise a stale prompt lingers in every subscriber's UI exactly
+		// like the bug Withdrawn was introduced to fix for ctx-cancel and
+		// ClaimResponse.
+		srv.publishWithdrawn(pending.message.RequestId, pending.message.Request, 0)
+	}
+}
+
+// broadcastLocked returns the subscribers whose active state and filter
+// match req, excluding exceptSubscriberID (0 excludes none) and buffering
+// message into the queue of any subscriber that hasn't completed activation
+// yet (see subscribeLocked). Callers must hold srv.mutex; the returned
+// subscriptions should be handed to deliver once it is released.
+func (srv *NotificationService) broadcastLocked(req *api.NotifyRequest, message *api.SubscribeResponse, exceptSubscriberID uint64) []*subscription {
+	var targets []*subscription
+	for _, subscription := range srv.subscriptions {
+		if exceptSubscriberID != 0 && subscription.id == exceptSubscriberID {
+			continue
+		}
+		if !subscription.supports(req) {
+			continue
+		}
+		if !subscription.ready {
+			subscription.queue = append(subscription.queue, message)
+			continue
+		}
+		targets = append(targets, subscription)
+	}
+	return targets
+}
+
+// broadcast is the unlocked counterpart to broadcastLocked: it acquires
+// srv.mutex itself and delivers to every matching subscriber once released.
+func (srv *NotificationService) broadcast(req *api.NotifyRequest, message *api.SubscribeResponse, exceptSubscriberID uint64) {
+	srv.mutex.Lock()
+	targets := srv.broadcastLocked(req, message, exceptSubscriberID)
+	srv.mutex.Unlock()
+
+	for _, subscription := range targets {
+		srv.deliver(subscription, message)
+	}
+}
+
+// publishSystemEvent broadcasts a synthetic notification on systemTopic so
+// tooling can observe subscribe/unsubscribe lifecycle events on the
+// notification bus itself. Unlike Notify, this is fire-and-forget: nothing
+// waits on a response, so it never enters pendingNotifications.
+func (srv *NotificationService) publishSystemEvent(message string) {
+	req := &api.NotifyRequest{Topic: systemTopic, Message: message}
+	srv.broadcast(req, &api.SubscribeResponse{Request: req}, 0)
+}
+
+// publishWithdrawn tells every subscriber except exceptSubscriberID (pass 0
+// to exclude none) that requestID is no longer open for a response, so their
+// UIs can dismiss a now-stale prompt: either because a ClaimResponse winner
+// is about to respond, because its lease expired, or because the original
+// Notify call was cancelled.
+func (srv *NotificationService) publishWithdrawn(requestID uint64, req *api.NotifyRequest, exceptSubscriberID uint64) {
+	withdrawn := &api.SubscribeResponse{
+		RequestId: requestID,
+		Withdrawn: &api.Withdrawn{RequestId: requestID},
+	}
+	srv.broadcast(req, withdrawn, exceptSubscriberID)
+}
+
+// ClaimResponse grants requestID's response to the first caller presenting
+// its current ResponderToken, then tells every other subscriber to withdraw
+// the prompt. Respond requires a successful claim first, so two subscribers
+// racing to answer the same notification can't both believe they won.
+//
+// req.SubscriberId identifies the caller's own Subscribe stream, learned
+// from the SubscribeResponse.Activated sentinel, so its own UI isn't told to
+// withdraw a prompt it just won. It also lets the service expire the claim,
+// without forcing any deadline onto the user, as soon as that subscription
+// disconnects without responding (see unsubscribeLocked); absent a
+// SubscriberId, the claim instead falls back to claimResponseFallbackTimeout
+// so a claimer that never identifies itself still can't wedge the
+// notification forever.
+func (srv *NotificationService) ClaimResponse(ctx context.Context, req *api.ClaimResponseRequest) (*api.ClaimResponseResponse, error) {
+	srv.mutex.Lock()
+	pending, ok := srv.pendingNotifications[req.RequestId]
+	if !ok {
+		srv.mutex.Unlock()
+		return nil, status.Errorf(codes.NotFound, "no pending notification with id %d", req.RequestId)
+	}
+	if pending.responderToken != req.ResponderToken {
+		srv.mutex.Unlock()
+		return nil, status.Error(codes.FailedPrecondition, "responder token is stale")
+	}
+	if pending.claimed {
+		srv.mutex.Unlock()
+		return nil, status.Error(codes.AlreadyExists, "notification already claimed by another subscriber")
+	}
+	pending.claimed = true
+	if req.SubscriberId != 0 {
+		// Expired by unsubscribeLocked when this subscription disconnects,
+		// not by a fixed deadline: the user is still free to take as long as
+		// they need to respond.
+		pending.claimedBySubscriberID = req.SubscriberId
+	} else if pending.leaseDeadline.IsZero() {
+		pending.leaseDeadline = time.Now().Add(claimResponseFallbackTimeout)
+	}
+	notifyReq := pending.message.Request
+	srv.mutex.Unlock()
+
+	srv.publishWithdrawn(req.RequestId, notifyReq, req.SubscriberId)
+	return &api.ClaimResponseResponse{}, nil
+}
+
+// deliver writes message to subscription's channel. If the channel is
+// momentarily full it blocks for up to backpressureTimeout before giving up,
+// rather than immediately evicting the subscriber, so a slow front-end can
+// survive a brief GC pause. Must be called without srv.mutex held.
+func (srv *NotificationService) deliver(subscription *subscription, message *api.SubscribeResponse) {
+	select {
+	case subscription.channel <- message:
+		return
+	default:
+	}
+
+	timer := time.NewTimer(srv.backpressureTimeout)
+	defer timer.Stop()
+	select {
+	case subscription.channel <- message:
+	case <-timer.C:
+		log.WithField("subscription", subscription.id).Info("Cancelling unresponsive subscriber")
+		srv.mutex.Lock()
+		delete(srv.subscriptions, subscription.id)
+		srv.mutex.Unlock()
+		subscription.close()
+	}
+}
+
 func isBlocking(req *api.NotifyRequest) bool {
-	return len(req.Actions) > 0 || req.Open != nil || req.Preview != nil
+	return len(req.Actions) > 0 || req.Open != nil || req.Preview != nil || req.Progress != nil
+}
+
+// progressLeaseDuration resolves the lease a progress notification is given
+// before a ReportProgress renewal is required, defaulting to
+// defaultProgressLeaseSeconds unless the caller overrode it.
+func progressLeaseDuration(req *api.NotifyRequest) time.Duration {
+	if req.LeaseSeconds > 0 {
+		return time.Duration(req.LeaseSeconds) * time.Second
+	}
+	return defaultProgressLeaseSeconds * time.Second
 }
 
 func (s *subscription) supports(req *api.NotifyRequest) bool {
-	return s.active == req.Active
+	if s.active != req.Active {
+		return false
+	}
+	return s.filter.matches(req)
 }
 
 // Subscribe subscribes to notifications that are sent to the supervisor.
@@ -186,9 +609,18 @@ func (srv *NotificationService) Subscribe(req *api.SubscribeRequest, resp api.No
 
 func (srv *NotificationService) subscribeLocked(req *api.SubscribeRequest, resp api.NotificationService_SubscribeServer) *subscription {
 	srv.mutex.Lock()
-	defer srv.mutex.Unlock()
-	// account for some back pressure
-	capacity := len(srv.pendingNotifications)
+	// Reading the backlog and the checkpoint while holding srv.mutex keeps
+	// this atomic with notifySubscribers' sequence assignment and store
+	// Append: otherwise a racing Notify could land between the Since call
+	// and the checkpoint read below, landing in neither the backlog sent
+	// here nor any future replay.
+	records, err := srv.store.Since(req.SinceSequence)
+	if err != nil {
+		log.WithError(err).Error("failed to load persisted notifications for replay")
+	}
+	// account for some back pressure, plus the Checkpoint and Activated
+	// sentinels sent below
+	capacity := len(records) + 2
 	if SubscriberMaxPendingNotifications > capacity {
 		capacity = SubscriberMaxPendingNotifications
 	}
@@ -198,36 +630,82 @@ func (srv *NotificationService) subscribeLocked(req *api.SubscribeRequest, resp
 	_, cancel := context.WithCancel(resp.Context())
 	subscription := &subscription{
 		active:  req.Active,
+		filter:  newSubscriptionFilter(req.Filter),
 		channel: channel,
 		id:      id,
 		cancel:  cancel,
 	}
 	srv.subscriptions[id] = subscription
+	// the last sequence issued so far (0 if none), since Since is exclusive
+	checkpoint := srv.nextSequence - 1
 
-	log.WithField("pending", len(srv.pendingNotifications)).Debug("sending pending notifications")
-	for id, pending := range srv.pendingNotifications {
-		if !subscription.supports(pending.message.Request) {
+	log.WithField("pending", len(records)).Debug("sending pending notifications")
+	for _, record := range records {
+		if record.Answered || !subscription.supports(record.Message.Request) {
 			continue
 		}
-		channel <- pending.message
-		if !isBlocking(pending.message.Request) {
-			delete(srv.pendingNotifications, id)
-		}
+		channel <- record.Message
 	}
+	// Checkpoint: the client persists this and passes it back as
+	// SinceSequence on its next Subscribe call, e.g. after a supervisor
+	// restart, so it only replays what it hasn't already seen.
+	channel <- &api.SubscribeResponse{Checkpoint: &api.Checkpoint{Sequence: checkpoint}}
+	// Activation ack: tells the client the backlog above is complete, and
+	// hands it its own subscriber id to echo back as
+	// ClaimResponseRequest.SubscriberId so a ClaimResponse it wins doesn't
+	// also tell its own UI to withdraw the prompt. Any notifySubscribers call
+	// racing us until this point buffered into subscription.queue instead of
+	// dropping, since subscription.ready is still false.
+	channel <- &api.SubscribeResponse{Activated: true, SubscriberId: id}
+
+	queue := subscription.queue
+	subscription.queue = nil
+	subscription.ready = true
+	srv.mutex.Unlock()
+
+	// Drain without the lock held: the reader loop in Subscribe only starts
+	// once this call returns, so draining must go through srv.deliver's
+	// backpressure handling rather than a direct (and potentially blocking)
+	// channel send.
+	for _, message := range queue {
+		srv.deliver(subscription, message)
+	}
+	srv.publishSystemEvent(fmt.Sprintf("subscriber %d connected", id))
 
 	return subscription
 }
 
 func (srv *NotificationService) unsubscribeLocked(subscriptionID uint64) {
 	srv.mutex.Lock()
-	defer srv.mutex.Unlock()
 	subscription, ok := srv.subscriptions[subscriptionID]
 	if !ok {
+		srv.mutex.Unlock()
 		log.Errorf("Could not unsubscribe subscriber")
 		return
 	}
 	delete(srv.subscriptions, subscription.id)
 	subscription.close()
+
+	// Any notification this subscriber claimed but never responded to would
+	// otherwise wedge Notify forever: nothing else removes it from
+	// pendingNotifications once claimed (see ClaimResponse).
+	var abandoned []*pendingNotification
+	for requestID, pending := range srv.pendingNotifications {
+		if pending.claimedBySubscriberID != subscriptionID {
+			continue
+		}
+		delete(srv.pendingNotifications, requestID)
+		abandoned = append(abandoned, pending)
+	}
+	srv.mutex.Unlock()
+
+	for _, pending := range abandoned {
+		log.WithField("requestId", pending.message.RequestId).Info("claiming subscriber disconnected without responding")
+		pending.expire()
+		srv.publishWithdrawn(pending.message.RequestId, pending.message.Request, 0)
+	}
+
+	srv.publishSystemEvent(fmt.Sprintf("subscriber %d disconnected", subscriptionID))
 }
 
 // Respond reports user actions as response to a notification request.
@@ -239,6 +717,9 @@ func (srv *NotificationService) Respond(ctx context.Context, req *api.RespondReq
 		log.WithField("requestId", req.RequestId).Info("invalid or late response to notification")
 		return nil, status.Errorf(codes.DeadlineExceeded, "invalid or late response to notification")
 	}
+	if !pending.claimed {
+		return nil, status.Errorf(codes.FailedPrecondition, "must claim notification %d via ClaimResponse before responding", req.RequestId)
+	}
 	if !validateResponse(req.Response, pending.message.Request) {
 		log.WithFields(map[string]interface{}{
 			"Notification": pending.message,
@@ -247,6 +728,9 @@ func (srv *NotificationService) Respond(ctx context.Context, req *api.RespondReq
 		}).Error("invalid notification")
 		return nil, status.Errorf(codes.InvalidArgument, "invalid notification")
 	}
+	if err := srv.store.MarkAnswered(req.RequestId, req.Response); err != nil {
+		log.WithError(err).Error("failed to mark notification answered in store")
+	}
 	if !pending.closed {
 		pending.responseChannel <- req.Response
 		pending.close()
@@ -0,0 +1,105 @@
+// Copyright (c) 2021 Gitpod GmbH. All rights reserved.
+// Licensed under the GNU Affero General Public License (AGPL).
+// See License.AGPL.txt in the project root for license information.
+
+package supervisor
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/gitpod-io/gitpod/supervisor/api"
+)
+
+// NotificationRecord is the durable form of a notification, keyed by its
+// Sequence rather than the in-memory pendingNotifications map, so it
+// survives a supervisor restart and can be replayed to a reconnecting
+// subscriber via NotificationStore.Since.
+type NotificationRecord struct {
+	Sequence uint64
+	Message  *api.SubscribeResponse
+	Answered bool
+	Response *api.NotifyResponse
+}
+
+// NotificationStore persists notifications so a supervisor restart (frequent
+// during workspace lifecycle) doesn't drop a blocking prompt or force a
+// reconnecting IDE to replay from an empty backlog.
+type NotificationStore interface {
+	// Append persists a newly created notification.
+	Append(record *NotificationRecord) error
+	// MarkAnswered records that sequence has been answered, before its
+	// pendingNotifications entry is discarded.
+	MarkAnswered(sequence uint64, response *api.NotifyResponse) error
+	// Since returns every persisted record with Sequence > sinceSequence,
+	// ordered by Sequence.
+	Since(sinceSequence uint64) ([]*NotificationRecord, error)
+	// NextSequence returns one past the highest Sequence persisted so far, or
+	// 0 if the store is empty. NewNotificationServiceWithStore seeds
+	// NotificationService.nextSequence from this on startup, so a restart
+	// resumes numbering instead of reusing - and overwriting - sequences a
+	// prior process already persisted.
+	NextSequence() (uint64, error)
+}
+
+// memoryNotificationStore is the default NotificationStore: it keeps records
+// only for the lifetime of the process, matching the pre-persistence
+// behaviour.
+type memoryNotificationStore struct {
+	mu      sync.Mutex
+	records []*NotificationRecord
+}
+
+// NewMemoryNotificationStore creates a NotificationStore that keeps records
+// in memory only.
+func NewMemoryNotificationStore() NotificationStore {
+	return &memoryNotificationStore{}
+}
+
+func (s *memoryNotificationStore) Append(record *NotificationRecord) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.records = append(s.records, record)
+	return nil
+}
+
+func (s *memoryNotificationStore) MarkAnswered(sequence uint64, response *api.NotifyResponse) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, record := range s.records {
+		if record.Sequence != sequence {
+			continue
+		}
+		record.Answered = true
+		record.Response = response
+		return nil
+	}
+	return fmt.Errorf("no notification with sequence %d", sequence)
+}
+
+func (s *memoryNotificationStore) Since(sinceSequence uint64) ([]*NotificationRecord, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var records []*NotificationRecord
+	for _, record := range s.records {
+		if record.Sequence > sinceSequence {
+			records = append(records, record)
+		}
+	}
+	return records, nil
+}
+
+func (s *memoryNotificationStore) NextSequence() (uint64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.records) == 0 {
+		return 0, nil
+	}
+	max := s.records[0].Sequence
+	for _, record := range s.records[1:] {
+		if record.Sequence > max {
+			max = record.Sequence
+		}
+	}
+	return max + 1, nil
+}
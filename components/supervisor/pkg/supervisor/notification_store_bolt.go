@@ -0,0 +1,183 @@
+// Copyright (c) 2021 Gitpod GmbH. All rights reserved.
+// Licensed under the GNU Affero General Public License (AGPL).
+// See License.AGPL.txt in the project root for license information.
+
+package supervisor
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	bolt "go.etcd.io/bbolt"
+	"google.golang.org/protobuf/encoding/protojson"
+
+	"github.com/gitpod-io/gitpod/supervisor/api"
+)
+
+const (
+	// notificationStoreDir is where the persisted notification store lives,
+	// inside the workspace so it survives a supervisor restart but not a
+	// workspace deletion.
+	notificationStoreDir  = "/workspace/.gitpod"
+	notificationStoreFile = "notifications.db"
+	notificationsBucket   = "notifications"
+)
+
+// boltNotificationStore persists NotificationRecords to a BoltDB file under
+// notificationStoreDir, keyed by their big-endian Sequence so Since can
+// range-scan forward from a given checkpoint.
+type boltNotificationStore struct {
+	db *bolt.DB
+}
+
+// NewBoltNotificationStore opens (creating if necessary) the notification
+// store at notificationStoreDir/notificationStoreFile.
+func NewBoltNotificationStore() (NotificationStore, error) {
+	if err := os.MkdirAll(notificationStoreDir, 0755); err != nil {
+		return nil, fmt.Errorf("cannot create notification store directory: %w", err)
+	}
+	db, err := bolt.Open(filepath.Join(notificationStoreDir, notificationStoreFile), 0600, nil)
+	if err != nil {
+		return nil, fmt.Errorf("cannot open notification store: %w", err)
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists([]byte(notificationsBucket))
+		return err
+	})
+	if err != nil {
+		_ = db.Close()
+		return nil, fmt.Errorf("cannot initialise notification store: %w", err)
+	}
+	return &boltNotificationStore{db: db}, nil
+}
+
+func (s *boltNotificationStore) Append(record *NotificationRecord) error {
+	data, err := marshalNotificationRecord(record)
+	if err != nil {
+		return err
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(notificationsBucket)).Put(sequenceKey(record.Sequence), data)
+	})
+}
+
+func (s *boltNotificationStore) MarkAnswered(sequence uint64, response *api.NotifyResponse) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(notificationsBucket))
+		key := sequenceKey(sequence)
+		data := bucket.Get(key)
+		if data == nil {
+			return fmt.Errorf("no notification with sequence %d", sequence)
+		}
+		record, err := unmarshalNotificationRecord(data)
+		if err != nil {
+			return err
+		}
+		record.Answered = true
+		record.Response = response
+		data, err = marshalNotificationRecord(record)
+		if err != nil {
+			return err
+		}
+		return bucket.Put(key, data)
+	})
+}
+
+func (s *boltNotificationStore) Since(sinceSequence uint64) ([]*NotificationRecord, error) {
+	var records []*NotificationRecord
+	err := s.db.View(func(tx *bolt.Tx) error {
+		cursor := tx.Bucket([]byte(notificationsBucket)).Cursor()
+		for k, v := cursor.Seek(sequenceKey(sinceSequence + 1)); k != nil; k, v = cursor.Next() {
+			record, err := unmarshalNotificationRecord(v)
+			if err != nil {
+				return err
+			}
+			records = append(records, record)
+		}
+		return nil
+	})
+	return records, err
+}
+
+func (s *boltNotificationStore) NextSequence() (uint64, error) {
+	var next uint64
+	err := s.db.View(func(tx *bolt.Tx) error {
+		k, _ := tx.Bucket([]byte(notificationsBucket)).Cursor().Last()
+		if k == nil {
+			next = 0
+			return nil
+		}
+		next = binary.BigEndian.Uint64(k) + 1
+		return nil
+	})
+	return next, err
+}
+
+// Close releases the underlying BoltDB file handle.
+func (s *boltNotificationStore) Close() error {
+	return s.db.Close()
+}
+
+func sequenceKey(sequence uint64) []byte {
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, sequence)
+	return key
+}
+
+// notificationRecordEnvelope is NotificationRecord's on-disk shape: Message
+// and Response are generated proto messages, so they're marshaled with
+// protojson rather than folded into the plain encoding/json document
+// alongside Sequence/Answered. Marshaling proto messages with encoding/json
+// directly happens to round-trip today, but silently mis-encodes the moment
+// the schema grows a oneof or a well-known type like timestamppb.Timestamp.
+type notificationRecordEnvelope struct {
+	Sequence uint64          `json:"sequence"`
+	Message  json.RawMessage `json:"message"`
+	Answered bool            `json:"answered"`
+	Response json.RawMessage `json:"response,omitempty"`
+}
+
+func marshalNotificationRecord(record *NotificationRecord) ([]byte, error) {
+	message, err := protojson.Marshal(record.Message)
+	if err != nil {
+		return nil, fmt.Errorf("cannot marshal notification message: %w", err)
+	}
+	envelope := notificationRecordEnvelope{
+		Sequence: record.Sequence,
+		Message:  message,
+		Answered: record.Answered,
+	}
+	if record.Response != nil {
+		response, err := protojson.Marshal(record.Response)
+		if err != nil {
+			return nil, fmt.Errorf("cannot marshal notification response: %w", err)
+		}
+		envelope.Response = response
+	}
+	return json.Marshal(&envelope)
+}
+
+func unmarshalNotificationRecord(data []byte) (*NotificationRecord, error) {
+	var envelope notificationRecordEnvelope
+	if err := json.Unmarshal(data, &envelope); err != nil {
+		return nil, err
+	}
+	record := &NotificationRecord{
+		Sequence: envelope.Sequence,
+		Answered: envelope.Answered,
+		Message:  &api.SubscribeResponse{},
+	}
+	if err := protojson.Unmarshal(envelope.Message, record.Message); err != nil {
+		return nil, fmt.Errorf("cannot unmarshal notification message: %w", err)
+	}
+	if len(envelope.Response) > 0 {
+		record.Response = &api.NotifyResponse{}
+		if err := protojson.Unmarshal(envelope.Response, record.Response); err != nil {
+			return nil, fmt.Errorf("cannot unmarshal notification response: %w", err)
+		}
+	}
+	return record, nil
+}
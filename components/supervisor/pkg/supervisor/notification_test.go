@@ -0,0 +1,438 @@
+// Copyright (c) 2021 Gitpod GmbH. All rights reserved.
+// Licensed under the GNU Affero General Public License (AGPL).
+// See License.AGPL.txt in the project root for license information.
+
+package supervisor
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/gitpod-io/gitpod/supervisor/api"
+)
+
+func newTestNotificationService() *NotificationService {
+	return NewNotificationServiceWithStore(NewMemoryNotificationStore())
+}
+
+// addTestSubscription registers a subscription directly, bypassing
+// subscribeLocked/Subscribe's gRPC plumbing, so tests can drive
+// broadcastLocked and deliver against a known channel without faking a
+// streaming RPC server.
+func addTestSubscription(srv *NotificationService, id uint64, ready bool, capacity int) *subscription {
+	sub := &subscription{
+		id:      id,
+		channel: make(chan *api.SubscribeResponse, capacity),
+		ready:   ready,
+		cancel:  func() {},
+	}
+	srv.mutex.Lock()
+	srv.subscriptions[id] = sub
+	srv.mutex.Unlock()
+	return sub
+}
+
+func TestBroadcastLockedBuffersUntilSubscriberActive(t *testing.T) {
+	srv := newTestNotificationService()
+	sub := addTestSubscription(srv, 1, false /* not yet activated */, 1)
+
+	req := &api.NotifyRequest{Message: "hello"}
+	message := &api.SubscribeResponse{Request: req}
+
+	srv.mutex.Lock()
+	targets := srv.broadcastLocked(req, message, 0)
+	srv.mutex.Unlock()
+
+	if len(targets) != 0 {
+		t.Fatalf("expected a not-yet-active subscriber to not be a delivery target, got %d", len(targets))
+	}
+	if len(sub.queue) != 1 || sub.queue[0] != message {
+		t.Fatalf("expected the notification to be buffered into sub.queue, got %v", sub.queue)
+	}
+	select {
+	case <-sub.channel:
+		t.Fatal("message must not be written to the channel before activation, a fast Notify racing Subscribe must never be dropped nor delivered early")
+	default:
+	}
+
+	// Once activation completes, a subsequent notification is delivered
+	// directly instead of being buffered.
+	srv.mutex.Lock()
+	sub.ready = true
+	targets = srv.broadcastLocked(req, &api.SubscribeResponse{Request: req}, 0)
+	srv.mutex.Unlock()
+	if len(targets) != 1 || targets[0] != sub {
+		t.Fatalf("expected the now-active subscriber to be a delivery target, got %v", targets)
+	}
+}
+
+func TestDeliverBlocksThenEvictsOnBackpressureTimeout(t *testing.T) {
+	srv := newTestNotificationService()
+	srv.backpressureTimeout = 30 * time.Millisecond
+	sub := addTestSubscription(srv, 1, true, 1)
+
+	// Fill the channel so the next deliver has to fall back to the
+	// backpressure path instead of an immediate send.
+	sub.channel <- &api.SubscribeResponse{}
+
+	done := make(chan struct{})
+	go func() {
+		srv.deliver(sub, &api.SubscribeResponse{RequestId: 42})
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("deliver did not return within the backpressure timeout")
+	}
+
+	srv.mutex.Lock()
+	_, stillSubscribed := srv.subscriptions[sub.id]
+	srv.mutex.Unlock()
+	if stillSubscribed {
+		t.Fatal("expected deliver to cancel a subscriber that stayed full past backpressureTimeout")
+	}
+	if !sub.closed {
+		t.Fatal("expected the evicted subscriber's channel to be closed")
+	}
+}
+
+func TestDeliverSucceedsOnceBackpressureClears(t *testing.T) {
+	srv := newTestNotificationService()
+	srv.backpressureTimeout = time.Second
+	sub := addTestSubscription(srv, 1, true, 1)
+	sub.channel <- &api.SubscribeResponse{}
+
+	done := make(chan struct{})
+	go func() {
+		srv.deliver(sub, &api.SubscribeResponse{RequestId: 7})
+		close(done)
+	}()
+
+	// Drain the blocking first message well before backpressureTimeout
+	// elapses; deliver should then succeed rather than evicting the
+	// subscriber.
+	<-sub.channel
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("deliver did not return after backpressure cleared")
+	}
+
+	select {
+	case msg := <-sub.channel:
+		if msg.RequestId != 7 {
+			t.Fatalf("expected the buffered message to arrive, got %v", msg)
+		}
+	default:
+		t.Fatal("expected deliver to have written the message once the channel had room")
+	}
+	srv.mutex.Lock()
+	_, stillSubscribed := srv.subscriptions[sub.id]
+	srv.mutex.Unlock()
+	if !stillSubscribed {
+		t.Fatal("a subscriber that drains in time must not be evicted")
+	}
+}
+
+func TestClaimResponseElectsSingleWinnerAndWithdrawsOthers(t *testing.T) {
+	srv := newTestNotificationService()
+	winner := addTestSubscription(srv, 1, true, 4)
+	loser := addTestSubscription(srv, 2, true, 4)
+
+	req := &api.NotifyRequest{Actions: []string{"Yes", "No"}}
+	pending := srv.notifySubscribers(req)
+	// Drain the initial prompt off both channels before racing the claim.
+	<-winner.channel
+	<-loser.channel
+
+	claim := func(subscriberID uint64) error {
+		_, err := srv.ClaimResponse(context.Background(), &api.ClaimResponseRequest{
+			RequestId:      pending.message.RequestId,
+			ResponderToken: pending.message.ResponderToken,
+			SubscriberId:   subscriberID,
+		})
+		return err
+	}
+
+	if err := claim(winner.id); err != nil {
+		t.Fatalf("expected the first ClaimResponse to succeed, got %v", err)
+	}
+	if err := claim(loser.id); err == nil {
+		t.Fatal("expected a second ClaimResponse for the same notification to fail")
+	}
+
+	select {
+	case msg := <-loser.channel:
+		if msg.Withdrawn == nil || msg.Withdrawn.RequestId != pending.message.RequestId {
+			t.Fatalf("expected the losing subscriber to receive a Withdrawn, got %v", msg)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("losing subscriber never received a Withdrawn message")
+	}
+
+	select {
+	case msg := <-winner.channel:
+		t.Fatalf("expected the claiming subscriber to not receive its own Withdrawn, got %v", msg)
+	default:
+	}
+}
+
+func TestClaimedNotificationExpiresWhenClaimingSubscriberDisconnects(t *testing.T) {
+	srv := newTestNotificationService()
+	claimer := addTestSubscription(srv, 1, true, 4)
+
+	req := &api.NotifyRequest{Actions: []string{"Yes"}}
+	pending := srv.notifySubscribers(req)
+	<-claimer.channel // initial prompt
+
+	if _, err := srv.ClaimResponse(context.Background(), &api.ClaimResponseRequest{
+		RequestId:      pending.message.RequestId,
+		ResponderToken: pending.message.ResponderToken,
+		SubscriberId:   claimer.id,
+	}); err != nil {
+		t.Fatalf("ClaimResponse failed: %v", err)
+	}
+
+	// Simulate the claimer's Subscribe stream disconnecting before it calls
+	// Respond: the claim must be abandoned right away rather than wedging
+	// Notify until claimResponseFallbackTimeout elapses.
+	srv.unsubscribeLocked(claimer.id)
+
+	select {
+	case _, ok := <-pending.responseChannel:
+		if ok {
+			t.Fatal("expected the response channel to be closed, not produce a response")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expected Notify's response channel to close once the claiming subscriber disconnected")
+	}
+	if !pending.expired {
+		t.Fatal("expected the abandoned claim to be reported as an expired lease, not a normal close")
+	}
+
+	srv.mutex.Lock()
+	_, stillPending := srv.pendingNotifications[pending.message.RequestId]
+	srv.mutex.Unlock()
+	if stillPending {
+		t.Fatal("expected the abandoned claim to be removed from pendingNotifications")
+	}
+}
+
+func TestSubscriptionFilterMatches(t *testing.T) {
+	tests := []struct {
+		name   string
+		filter *api.Filter
+		req    *api.NotifyRequest
+		want   bool
+	}{
+		{
+			name: "nil filter matches everything",
+			req:  &api.NotifyRequest{Topic: "git", Message: "anything"},
+			want: true,
+		},
+		{
+			name:   "topic set rejects a non-member topic",
+			filter: &api.Filter{Topics: []string{"git"}},
+			req:    &api.NotifyRequest{Topic: "ports"},
+			want:   false,
+		},
+		{
+			name:   "topic set accepts a member topic",
+			filter: &api.Filter{Topics: []string{"git", "ports"}},
+			req:    &api.NotifyRequest{Topic: "ports"},
+			want:   true,
+		},
+		{
+			name:   "level below MinLevel is rejected",
+			filter: &api.Filter{Level: api.NotifyRequest_WARN},
+			req:    &api.NotifyRequest{Level: api.NotifyRequest_INFO},
+			want:   false,
+		},
+		{
+			name:   "level at or above MinLevel is accepted",
+			filter: &api.Filter{Level: api.NotifyRequest_WARN},
+			req:    &api.NotifyRequest{Level: api.NotifyRequest_ERROR},
+			want:   true,
+		},
+		{
+			name:   "message glob mismatch is rejected",
+			filter: &api.Filter{Message: "prebuild-*"},
+			req:    &api.NotifyRequest{Message: "git-sync"},
+			want:   false,
+		},
+		{
+			name:   "message glob match is accepted",
+			filter: &api.Filter{Message: "prebuild-*"},
+			req:    &api.NotifyRequest{Message: "prebuild-123"},
+			want:   true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := newSubscriptionFilter(tt.filter).matches(tt.req); got != tt.want {
+				t.Fatalf("matches() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSubscriptionSupportsChecksActiveThenFilter(t *testing.T) {
+	sub := &subscription{active: true, filter: newSubscriptionFilter(&api.Filter{Topics: []string{"git"}})}
+
+	if sub.supports(&api.NotifyRequest{Active: false, Topic: "git"}) {
+		t.Fatal("expected a mismatched Active to reject regardless of the filter")
+	}
+	if sub.supports(&api.NotifyRequest{Active: true, Topic: "ports"}) {
+		t.Fatal("expected a matching Active but non-matching filter to reject")
+	}
+	if !sub.supports(&api.NotifyRequest{Active: true, Topic: "git"}) {
+		t.Fatal("expected a matching Active and filter to be supported")
+	}
+}
+
+func TestRenewLeaseExtendsDeadlineAndBroadcastsProgress(t *testing.T) {
+	srv := newTestNotificationService()
+	sub := addTestSubscription(srv, 1, true, 4)
+
+	pending := srv.notifySubscribers(&api.NotifyRequest{Progress: &api.Progress{}, LeaseSeconds: 1})
+	<-sub.channel // initial prompt
+
+	srv.mutex.Lock()
+	before := pending.leaseDeadline
+	srv.mutex.Unlock()
+	if before.IsZero() {
+		t.Fatal("expected a progress notification to start with a non-zero leaseDeadline")
+	}
+
+	if err := srv.renewLease(&api.ProgressUpdate{RequestId: pending.message.RequestId, Percent: 50}); err != nil {
+		t.Fatalf("renewLease failed: %v", err)
+	}
+
+	srv.mutex.Lock()
+	after := pending.leaseDeadline
+	srv.mutex.Unlock()
+	if !after.After(before) {
+		t.Fatalf("expected renewLease to push the deadline forward, got before=%v after=%v", before, after)
+	}
+
+	select {
+	case msg := <-sub.channel:
+		if msg.ProgressUpdate == nil || msg.ProgressUpdate.Percent != 50 {
+			t.Fatalf("expected the progress update to be broadcast to the subscriber, got %v", msg)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expected renewLease to broadcast the progress update")
+	}
+}
+
+func TestExpireLeasesClosesAndWithdrawsStaleProgress(t *testing.T) {
+	srv := newTestNotificationService()
+	sub := addTestSubscription(srv, 1, true, 4)
+
+	pending := srv.notifySubscribers(&api.NotifyRequest{Progress: &api.Progress{}})
+	<-sub.channel // initial prompt
+
+	// Force the lease into the past instead of waiting out
+	// defaultProgressLeaseSeconds, so expireLeases has something to sweep.
+	srv.mutex.Lock()
+	pending.leaseDeadline = time.Now().Add(-time.Second)
+	srv.mutex.Unlock()
+
+	srv.expireLeases()
+
+	select {
+	case _, ok := <-pending.responseChannel:
+		if ok {
+			t.Fatal("expected the response channel to be closed, not produce a response")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expected expireLeases to close the response channel")
+	}
+	if !pending.expired {
+		t.Fatal("expected expireLeases to mark the notification expired")
+	}
+
+	select {
+	case msg := <-sub.channel:
+		if msg.Withdrawn == nil || msg.Withdrawn.RequestId != pending.message.RequestId {
+			t.Fatalf("expected a Withdrawn broadcast once the lease expired, got %v", msg)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expected expireLeases to broadcast Withdrawn for the lapsed notification")
+	}
+
+	srv.mutex.Lock()
+	_, stillPending := srv.pendingNotifications[pending.message.RequestId]
+	srv.mutex.Unlock()
+	if stillPending {
+		t.Fatal("expected the expired notification to be removed from pendingNotifications")
+	}
+}
+
+// TestNotificationServiceResumesSequenceAcrossRestart covers the scenario
+// NewNotificationServiceWithStore exists for: a notification persisted
+// before a supervisor restart must not have its Sequence reused by the
+// fresh process, and a client's pre-restart SinceSequence checkpoint must
+// still see everything notified afterwards.
+func TestNotificationServiceResumesSequenceAcrossRestart(t *testing.T) {
+	store := NewMemoryNotificationStore()
+	srv1 := NewNotificationServiceWithStore(store)
+
+	beforeRestart := srv1.notifySubscribers(&api.NotifyRequest{Actions: []string{"Yes"}})
+	checkpoint := beforeRestart.message.Sequence
+
+	// Simulate a supervisor restart: a fresh service reopens the same store.
+	srv2 := NewNotificationServiceWithStore(store)
+
+	afterRestart := srv2.notifySubscribers(&api.NotifyRequest{Actions: []string{"Yes"}})
+	if afterRestart.message.Sequence <= checkpoint {
+		t.Fatalf("expected sequence numbering to resume past the pre-restart sequence %d, got %d", checkpoint, afterRestart.message.Sequence)
+	}
+	if afterRestart.message.Sequence == beforeRestart.message.Sequence {
+		t.Fatal("expected the post-restart notification to not collide with (and overwrite) the pre-restart one")
+	}
+
+	records, err := store.Since(checkpoint)
+	if err != nil {
+		t.Fatalf("Since failed: %v", err)
+	}
+	found := false
+	for _, record := range records {
+		if record.Sequence == afterRestart.message.Sequence {
+			found = true
+		}
+	}
+	if !found {
+		t.Fatal("expected a reconnecting client's pre-restart checkpoint to still replay the post-restart notification")
+	}
+}
+
+func TestStoreReplayOnlySurfacesUnansweredRecords(t *testing.T) {
+	store := NewMemoryNotificationStore()
+	srv := NewNotificationServiceWithStore(store)
+
+	blocking := srv.notifySubscribers(&api.NotifyRequest{Topic: "git", Actions: []string{"Yes"}})
+	srv.notifySubscribers(&api.NotifyRequest{Topic: "git", Message: "fyi"}) // non-blocking: answered immediately
+
+	records, err := store.Since(0)
+	if err != nil {
+		t.Fatalf("Since failed: %v", err)
+	}
+	if len(records) != 2 {
+		t.Fatalf("expected both notifications to be persisted, got %d", len(records))
+	}
+
+	var unanswered []*NotificationRecord
+	for _, record := range records {
+		if !record.Answered {
+			unanswered = append(unanswered, record)
+		}
+	}
+	if len(unanswered) != 1 || unanswered[0].Sequence != blocking.message.Sequence {
+		t.Fatalf("expected only the still-open blocking notification to remain unanswered in the store, got %v", unanswered)
+	}
+}